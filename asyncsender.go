@@ -0,0 +1,157 @@
+package gcm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// AsyncConfig configures an AsyncSender.
+type AsyncConfig struct {
+	// Workers is the number of goroutines pulling jobs off the queue.
+	// Defaults to 1.
+	Workers int
+	// QueueSize bounds how many submitted jobs can be pending before
+	// Submit blocks. Defaults to Workers.
+	QueueSize int
+	// RateLimitPerSecond caps how many jobs the worker pool starts per
+	// second, across all workers. Zero means unlimited.
+	RateLimitPerSecond int
+}
+
+// JobResult is delivered on an AsyncSender's Results channel once a
+// submitted message has been sent, or has permanently failed to send.
+type JobResult struct {
+	JobID        string
+	Response     *messaging.BatchResponse
+	FailedTokens []string
+	Err          error
+}
+
+type asyncJob struct {
+	id  string
+	msg *messaging.MulticastMessage
+}
+
+// AsyncSender wraps a Sender with a bounded worker pool, so a service can
+// push tens of thousands of notifications per second without every
+// caller managing its own goroutines and backpressure.
+type AsyncSender struct {
+	sender *Sender
+	cfg    AsyncConfig
+
+	jobs          chan asyncJob
+	results       chan JobResult
+	invalidTokens chan string
+	ticker        *time.Ticker
+
+	nextJobID uint64
+	wg        sync.WaitGroup
+	once      sync.Once
+}
+
+// NewAsyncSender returns an AsyncSender that delivers messages through s,
+// using cfg.Workers goroutines pulling from a queue of size
+// cfg.QueueSize.
+func NewAsyncSender(s *Sender, cfg AsyncConfig) *AsyncSender {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = cfg.Workers
+	}
+
+	as := &AsyncSender{
+		sender:        s,
+		cfg:           cfg,
+		jobs:          make(chan asyncJob, cfg.QueueSize),
+		results:       make(chan JobResult, cfg.QueueSize),
+		invalidTokens: make(chan string, cfg.QueueSize),
+	}
+	if cfg.RateLimitPerSecond > 0 {
+		as.ticker = time.NewTicker(time.Second / time.Duration(cfg.RateLimitPerSecond))
+	}
+
+	for i := 0; i < cfg.Workers; i++ {
+		as.wg.Add(1)
+		go as.work()
+	}
+
+	return as
+}
+
+// Submit enqueues msg for asynchronous delivery and returns a jobID that
+// will appear on the JobResult read from Results(). Submit blocks only
+// until the queue has room for msg; it returns ctx.Err() if ctx is
+// canceled first.
+func (as *AsyncSender) Submit(ctx context.Context, msg *messaging.MulticastMessage) (string, error) {
+	jobID := fmt.Sprintf("job-%d", atomic.AddUint64(&as.nextJobID, 1))
+	select {
+	case as.jobs <- asyncJob{id: jobID, msg: msg}:
+		return jobID, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Results returns the channel JobResults are published on as submitted
+// messages are sent.
+func (as *AsyncSender) Results() <-chan JobResult {
+	return as.results
+}
+
+// InvalidTokens returns the channel of registration tokens classified as
+// permanently invalid (unregistered, sender ID mismatch, or otherwise
+// rejected), so callers can drive their own database cleanup.
+func (as *AsyncSender) InvalidTokens() <-chan string {
+	return as.invalidTokens
+}
+
+// Shutdown stops accepting new jobs and waits for queued and in-flight
+// jobs to drain, up to ctx's deadline. It is safe to call more than once;
+// only the first call has effect. If ctx expires before every worker has
+// drained, Shutdown returns ctx.Err() but the workers are left running;
+// results and invalidTokens are only closed once they have actually
+// stopped, so a late-finishing worker never sends on a closed channel.
+func (as *AsyncSender) Shutdown(ctx context.Context) error {
+	var err error
+	as.once.Do(func() {
+		close(as.jobs)
+		drained := make(chan struct{})
+		go func() {
+			as.wg.Wait()
+			if as.ticker != nil {
+				as.ticker.Stop()
+			}
+			close(as.results)
+			close(as.invalidTokens)
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	})
+	return err
+}
+
+// work pulls jobs off the queue, sends each through the wrapped Sender,
+// and publishes the outcome, until the queue is closed by Shutdown.
+func (as *AsyncSender) work() {
+	defer as.wg.Done()
+	for job := range as.jobs {
+		if as.ticker != nil {
+			<-as.ticker.C
+		}
+		resp, failedTokens, invalidTokens, err := as.sender.Send(job.msg, 0)
+		as.results <- JobResult{JobID: job.id, Response: resp, FailedTokens: failedTokens, Err: err}
+		for _, t := range invalidTokens {
+			as.invalidTokens <- t.Token
+		}
+	}
+}
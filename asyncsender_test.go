@@ -0,0 +1,55 @@
+package gcm
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAsyncSenderSubmitAndResults(t *testing.T) {
+	server := startMessageTestServer(t, &messageResponse{MessageID: "projects/test/messages/1"})
+	defer server.Close()
+	client, _ := getMockClient(server)
+	sender := &Sender{CredentialsJson: "test", Client: client}
+	async := NewAsyncSender(sender, AsyncConfig{Workers: 1, QueueSize: 1})
+
+	msg := NewMessage(map[string]string{"key": "value"}, nil, "1")
+	jobID, err := async.Submit(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("submit failed: %s", err)
+	}
+
+	select {
+	case result := <-async.Results():
+		if result.JobID != jobID {
+			t.Fatalf("expected result for job %q, got %q", jobID, result.JobID)
+		}
+		if result.Err != nil {
+			t.Fatalf("job failed with error: %s", result.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for job result")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := async.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+}
+
+func TestAsyncSenderSubmitCanceled(t *testing.T) {
+	// Construct the AsyncSender directly, bypassing NewAsyncSender's
+	// worker goroutines, so the queue stays full and Submit has no choice
+	// but to wait on ctx.
+	async := &AsyncSender{jobs: make(chan asyncJob, 1)}
+	async.jobs <- asyncJob{id: "filler"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	msg := NewMessage(map[string]string{"key": "value"}, nil, "1")
+	if _, err := async.Submit(ctx, msg); err == nil {
+		t.Fatal("expected Submit to fail when ctx is already canceled")
+	}
+}
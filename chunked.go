@@ -0,0 +1,146 @@
+package gcm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// maxTokensPerSend mirrors the 500-token limit checkMessage enforces on a
+// single send.
+const maxTokensPerSend = 500
+
+// ChunkError reports which of the chunks dispatched by SendChunked failed
+// outright, as opposed to individual tokens within a chunk failing, which
+// show up in the merged BatchResponse and failedTokens instead. Chunks
+// that succeeded are still reflected in SendChunked's other return
+// values, so a partial failure across chunks does not lose them.
+type ChunkError struct {
+	// Errors maps the zero-based index of a failed chunk to the error it
+	// returned.
+	Errors map[int]error
+	// TotalChunks is the number of chunks msg.Tokens was split into.
+	TotalChunks int
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("gcm: %d of %d chunks failed to send", len(e.Errors), e.TotalChunks)
+}
+
+// SendChunked splits msg's Tokens into chunks of at most 500 — the limit
+// checkMessage enforces on a single send — dispatches each chunk through
+// Send, and merges the results back into a single BatchResponse with the
+// tokens in their original order, unioning the failed and invalid token
+// lists across chunks. Chunks are sent one at a time unless
+// s.MaxConcurrentChunks is set, in which case up to that many chunks are
+// dispatched concurrently. Each chunk honors the same retry and backoff
+// semantics as Send.
+func (s *Sender) SendChunked(msg *messaging.MulticastMessage, retries int) (*messaging.BatchResponse, []string, []InvalidToken, error) {
+	if msg == nil {
+		return nil, nil, nil, errors.New("the message must not be nil")
+	} else if len(msg.Tokens) == 0 {
+		return nil, nil, nil, errors.New("the message must specify at least one Token")
+	}
+
+	chunks := chunkTokens(msg.Tokens, maxTokensPerSend)
+	concurrency := s.MaxConcurrentChunks
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	responseChunks := make([][]*messaging.SendResponse, len(chunks))
+	chunkErrs := make([]error, len(chunks))
+	failedTokenChunks := make([][]string, len(chunks))
+	invalidTokenChunks := make([][]InvalidToken, len(chunks))
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, tokens := range chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, tokens []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			resp, failedTokens, invalidTokens, err := s.Send(withTokens(msg, tokens), retries)
+			if err != nil {
+				chunkErrs[i] = err
+				responseChunks[i] = failedResponses(tokens, err)
+				failedTokenChunks[i] = tokens
+				return
+			}
+			responseChunks[i] = resp.Responses
+			failedTokenChunks[i] = failedTokens
+			invalidTokenChunks[i] = invalidTokens
+		}(i, tokens)
+	}
+	wg.Wait()
+
+	var responses []*messaging.SendResponse
+	var failedTokens []string
+	var invalidTokens []InvalidToken
+	chunkErrors := make(map[int]error)
+	for i := range chunks {
+		responses = append(responses, responseChunks[i]...)
+		failedTokens = append(failedTokens, failedTokenChunks[i]...)
+		invalidTokens = append(invalidTokens, invalidTokenChunks[i]...)
+		if chunkErrs[i] != nil {
+			chunkErrors[i] = chunkErrs[i]
+		}
+	}
+
+	var successCount, failureCount int
+	for _, r := range responses {
+		if r.Success {
+			successCount++
+		} else {
+			failureCount++
+		}
+	}
+
+	batchResp := &messaging.BatchResponse{
+		SuccessCount: successCount,
+		FailureCount: failureCount,
+		Responses:    responses,
+	}
+
+	if len(chunkErrors) > 0 {
+		return batchResp, failedTokens, invalidTokens, &ChunkError{Errors: chunkErrors, TotalChunks: len(chunks)}
+	}
+	return batchResp, failedTokens, invalidTokens, nil
+}
+
+// chunkTokens splits tokens into contiguous slices of at most size
+// elements, preserving order.
+func chunkTokens(tokens []string, size int) [][]string {
+	chunks := make([][]string, 0, (len(tokens)+size-1)/size)
+	for len(tokens) > 0 {
+		n := size
+		if n > len(tokens) {
+			n = len(tokens)
+		}
+		chunks = append(chunks, tokens[:n])
+		tokens = tokens[n:]
+	}
+	return chunks
+}
+
+// withTokens returns a shallow copy of msg addressed to tokens instead of
+// msg.Tokens.
+func withTokens(msg *messaging.MulticastMessage, tokens []string) *messaging.MulticastMessage {
+	chunkMsg := *msg
+	chunkMsg.Tokens = tokens
+	return &chunkMsg
+}
+
+// failedResponses synthesizes a failing SendResponse for each of tokens,
+// for use when a whole chunk could not be sent.
+func failedResponses(tokens []string, err error) []*messaging.SendResponse {
+	responses := make([]*messaging.SendResponse, len(tokens))
+	for i := range tokens {
+		responses[i] = &messaging.SendResponse{Success: false, Error: err}
+	}
+	return responses
+}
@@ -0,0 +1,182 @@
+package gcm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"firebase.google.com/go/v4/errorutils"
+	"firebase.google.com/go/v4/messaging"
+)
+
+// ErrorCode classifies an error returned for a single token by the FCM v1
+// REST API, per the error classes documented at
+// https://firebase.google.com/docs/cloud-messaging/send-message#rest
+type ErrorCode string
+
+const (
+	// ErrorCodeUnregistered means the registration token is no longer
+	// valid, e.g. because the app was uninstalled or the token was
+	// refreshed. Callers should remove the token from their database.
+	ErrorCodeUnregistered ErrorCode = "UNREGISTERED"
+	// ErrorCodeInvalidArgument means the message itself was malformed.
+	// Retrying without changing the message will not help.
+	ErrorCodeInvalidArgument ErrorCode = "INVALID_ARGUMENT"
+	// ErrorCodeSenderIDMismatch means the registration token does not
+	// belong to the sender's project.
+	ErrorCodeSenderIDMismatch ErrorCode = "SENDER_ID_MISMATCH"
+	// ErrorCodeQuotaExceeded means a sending quota (project, device, or
+	// message rate) was exceeded. Retryable, ideally after the delay
+	// carried in the response's Retry-After header.
+	ErrorCodeQuotaExceeded ErrorCode = "QUOTA_EXCEEDED"
+	// ErrorCodeUnavailable means the FCM backend was temporarily
+	// overloaded. Retryable with backoff.
+	ErrorCodeUnavailable ErrorCode = "UNAVAILABLE"
+	// ErrorCodeInternal means FCM encountered an internal error.
+	// Retryable with backoff.
+	ErrorCodeInternal ErrorCode = "INTERNAL"
+	// ErrorCodeThirdPartyAuth means the APNs or web push credentials
+	// configured for the project were rejected.
+	ErrorCodeThirdPartyAuth ErrorCode = "THIRD_PARTY_AUTH_ERROR"
+	// ErrorCodeUnknown is returned for errors that don't map to one of
+	// the classes above.
+	ErrorCodeUnknown ErrorCode = "UNKNOWN"
+)
+
+// Typed sentinel errors for the classes above, for callers that prefer
+// errors.Is to switching on an ErrorCode.
+var (
+	ErrUnregistered     = errors.New("gcm: registration token is unregistered")
+	ErrInvalidArgument  = errors.New("gcm: invalid argument")
+	ErrSenderIDMismatch = errors.New("gcm: sender ID mismatch")
+	ErrQuotaExceeded    = errors.New("gcm: quota exceeded")
+	ErrUnavailable      = errors.New("gcm: FCM backend unavailable")
+	ErrInternal         = errors.New("gcm: FCM internal error")
+	ErrThirdPartyAuth   = errors.New("gcm: third-party auth error")
+)
+
+// InvalidToken pairs a registration token that failed permanently with the
+// ErrorCode explaining why, so callers can purge it from their database
+// instead of retrying it.
+type InvalidToken struct {
+	Token string
+	Code  ErrorCode
+}
+
+// Classify inspects err, as found on a messaging.SendResponse, and returns
+// the ErrorCode it belongs to. It returns ErrorCodeUnknown if err does not
+// match any of the documented FCM v1 error classes.
+func Classify(err error) ErrorCode {
+	err = classifiedCause(err)
+	switch {
+	case err == nil:
+		return ""
+	case messaging.IsRegistrationTokenNotRegistered(err):
+		return ErrorCodeUnregistered
+	case messaging.IsSenderIDMismatch(err):
+		return ErrorCodeSenderIDMismatch
+	case messaging.IsInvalidArgument(err):
+		return ErrorCodeInvalidArgument
+	case messaging.IsQuotaExceeded(err):
+		return ErrorCodeQuotaExceeded
+	case messaging.IsUnavailable(err):
+		return ErrorCodeUnavailable
+	case messaging.IsInternal(err):
+		return ErrorCodeInternal
+	case messaging.IsThirdPartyAuthError(err):
+		return ErrorCodeThirdPartyAuth
+	default:
+		return ErrorCodeUnknown
+	}
+}
+
+// wrapClassified wraps cause with the typed sentinel error matching code,
+// so callers can both errors.Is(err, gcm.ErrUnregistered) and still reach
+// cause's original FCM error. Classify and retryAfterDelay peel the
+// wrapper off again with classifiedCause, so they can re-inspect a value
+// that has already been through wrapClassified once.
+func wrapClassified(code ErrorCode, cause error) error {
+	sentinel, ok := map[ErrorCode]error{
+		ErrorCodeUnregistered:     ErrUnregistered,
+		ErrorCodeInvalidArgument:  ErrInvalidArgument,
+		ErrorCodeSenderIDMismatch: ErrSenderIDMismatch,
+		ErrorCodeQuotaExceeded:    ErrQuotaExceeded,
+		ErrorCodeUnavailable:      ErrUnavailable,
+		ErrorCodeInternal:         ErrInternal,
+		ErrorCodeThirdPartyAuth:   ErrThirdPartyAuth,
+	}[code]
+	if !ok {
+		return cause
+	}
+	return fmt.Errorf("%w: %w", sentinel, cause)
+}
+
+// classifiedCause returns the cause that wrapClassified wrapped to produce
+// err, or err itself if err did not come from wrapClassified.
+func classifiedCause(err error) error {
+	if w, ok := err.(interface{ Unwrap() []error }); ok {
+		if errs := w.Unwrap(); len(errs) == 2 {
+			switch errs[0] {
+			case ErrUnregistered, ErrInvalidArgument, ErrSenderIDMismatch, ErrQuotaExceeded, ErrUnavailable, ErrInternal, ErrThirdPartyAuth:
+				return errs[1]
+			}
+		}
+	}
+	return err
+}
+
+// isPermanentErrorCode reports whether code indicates a failure that
+// retrying will not fix, i.e. the token should be treated as invalid.
+func isPermanentErrorCode(code ErrorCode) bool {
+	switch code {
+	case ErrorCodeUnregistered, ErrorCodeInvalidArgument, ErrorCodeSenderIDMismatch:
+		return true
+	default:
+		return false
+	}
+}
+
+// isRecoverableError checks if the error is a recoverable error.
+// For more info, check out:
+// https://firebase.google.com/docs/cloud-messaging/send-message#rest
+func isRecoverableError(err error) bool {
+	switch Classify(err) {
+	case ErrorCodeUnavailable, ErrorCodeInternal, ErrorCodeQuotaExceeded:
+		return true
+	}
+	// Fall back to the legacy GCM HTTP error strings for errors that don't
+	// carry an FCM v1 error code, under the assumption that Legacy and
+	// HTTP V1 + SDK return the same errors.
+	switch err.Error() {
+	case ResponseErrorUnavailable, ResponseErrorInternalServerError:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfterDelay returns the delay requested by a Retry-After header on
+// the HTTP response underlying err, if FCM returned one. It is consulted
+// for ErrorCodeQuotaExceeded responses so the retry loop can honor FCM's
+// requested backoff instead of our own exponential schedule.
+func retryAfterDelay(err error) (time.Duration, bool) {
+	resp := errorutils.HTTPResponse(classifiedCause(err))
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, parseErr := strconv.Atoi(v); parseErr == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, parseErr := http.ParseTime(v); parseErr == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+	}
+	return 0, false
+}
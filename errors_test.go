@@ -0,0 +1,17 @@
+package gcm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWrapClassifiedPreservesCause(t *testing.T) {
+	cause := errors.New("backend overloaded")
+	err := wrapClassified(ErrorCodeUnavailable, cause)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatal("expected errors.Is to match the sentinel for the classified code")
+	}
+	if !errors.Is(err, cause) {
+		t.Fatal("expected errors.Is to still reach the original cause, e.g. for Classify to re-inspect it")
+	}
+}
@@ -15,10 +15,63 @@ func NewMessage(data map[string]string, notification *messaging.Notification, to
 		Tokens:       tokens,
 		Data:         data,
 		Notification: notification,
-		Android: &messaging.AndroidConfig{
-			Notification: &messaging.AndroidNotification{
-				Icon: AndroidNotificationIcon,
-			},
+		Android:      newAndroidConfig(),
+	}
+}
+
+// NewTopicMessage returns a new Message addressed to the given FCM topic,
+// e.g. "news".
+func NewTopicMessage(topic string, data map[string]string, notification *messaging.Notification) *messaging.Message {
+	return &messaging.Message{
+		Topic:        topic,
+		Data:         data,
+		Notification: notification,
+		Android:      newAndroidConfig(),
+	}
+}
+
+// NewConditionMessage returns a new Message addressed to devices matching
+// the given topic condition, e.g. "'stock' in topics && 'news' in topics".
+func NewConditionMessage(condition string, data map[string]string, notification *messaging.Notification) *messaging.Message {
+	return &messaging.Message{
+		Condition:    condition,
+		Data:         data,
+		Notification: notification,
+		Android:      newAndroidConfig(),
+	}
+}
+
+// NewSingleMessage returns a new Message addressed to a single
+// registration token.
+func NewSingleMessage(token string, data map[string]string, notification *messaging.Notification) *messaging.Message {
+	return &messaging.Message{
+		Token:        token,
+		Data:         data,
+		Notification: notification,
+		Android:      newAndroidConfig(),
+	}
+}
+
+// newAndroidConfig returns the AndroidConfig shared by every message
+// constructor in this package.
+func newAndroidConfig() *messaging.AndroidConfig {
+	return &messaging.AndroidConfig{
+		Notification: &messaging.AndroidNotification{
+			Icon: AndroidNotificationIcon,
 		},
 	}
 }
+
+// singleMessageFromMulticast returns the single-token Message that
+// SendEachNoRetry sends in place of one entry of msg's Tokens.
+func singleMessageFromMulticast(msg *messaging.MulticastMessage, token string) *messaging.Message {
+	return &messaging.Message{
+		Token:        token,
+		Data:         msg.Data,
+		Notification: msg.Notification,
+		Android:      msg.Android,
+		Webpush:      msg.Webpush,
+		APNS:         msg.APNS,
+		FCMOptions:   msg.FCMOptions,
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"firebase.google.com/go/v4/messaging"
 	"github.com/appleboy/go-fcm"
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -14,6 +15,9 @@ const (
 	backoffInitialDelay = 1000
 	// Maximum delay before a retry.
 	maxBackoffDelay = 1024000
+	// Maximum number of per-token requests that SendEachNoRetry will have
+	// in flight at once.
+	maxConcurrentSendEach = 10
 )
 
 // Errors
@@ -22,6 +26,8 @@ type JSONParseError struct{ error }
 type UnauthorizedError struct{ error }
 type UnknownError struct{ error }
 
+// Typed FCM v1 error classes are defined in errors.go.
+
 const (
 	ResponseErrorMissingRegistration = "MissingRegistration"
 	ResponseErrorInvalidRegistration = "InvalidRegistration"
@@ -52,120 +58,402 @@ const (
 type Sender struct {
 	CredentialsJson string
 	Client          *fcm.Client
+
+	// DryRun, when true, routes every send through FCM's validate-only
+	// mode: the request runs through auth, quota, and payload validation
+	// but no notification is actually delivered. The response shape is
+	// unchanged, so per-token successes and errors are still reported
+	// normally.
+	DryRun bool
+
+	// MaxConcurrentChunks caps how many 500-token chunks SendChunked
+	// dispatches at once. Zero (the default) sends chunks one at a time.
+	MaxConcurrentChunks int
 }
 
-// SendNoRetry sends a message to the FCM server without retrying in case of
-// service unavailability. A non-nil error is returned if a non-recoverable
-// error occurs.
-// If msg is a valid MulticastMessage, then the failed tokens will also be returned.
-func (s *Sender) SendNoRetry(msg *messaging.MulticastMessage) (*messaging.BatchResponse, []string, error) {
+// SendNoRetry sends a message to the FCM server without retrying in case
+// of service unavailability. It is a thin wrapper around
+// SendNoRetryContext using context.Background().
+func (s *Sender) SendNoRetry(msg *messaging.MulticastMessage) (*messaging.BatchResponse, []string, []InvalidToken, error) {
+	return s.SendNoRetryContext(context.Background(), msg)
+}
+
+// SendNoRetryContext sends a message to the FCM server without retrying in
+// case of service unavailability. A non-nil error is returned if a
+// non-recoverable error occurs.
+// If msg is a valid MulticastMessage, then the failed tokens and any
+// permanently invalid tokens found among them will also be returned.
+// Canceling ctx aborts the underlying HTTP call.
+func (s *Sender) SendNoRetryContext(ctx context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, []string, []InvalidToken, error) {
 	// Note that failed tokens returns as nil, since we cannot guarantee that msg.Tokens exists
 	if err := checkMessage(msg); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	} else if err = checkSender(s); err != nil {
-		return nil, msg.Tokens, err
+		return nil, msg.Tokens, nil, err
 	}
-	resp, err := s.Client.SendMulticast(context.Background(), msg)
+	resp, err := s.sendMulticast(ctx, msg)
 	if err != nil {
-		return resp, msg.Tokens, err
+		return resp, msg.Tokens, nil, wrapClassified(Classify(err), err)
 	}
 
-	// Collect failed tokens
+	// Collect failed and invalid tokens.
 	var failedTokens []string
+	var invalidTokens []InvalidToken
 	for idx, r := range resp.Responses {
 		if !r.Success {
 			failedTokens = append(failedTokens, msg.Tokens[idx])
+			if code := Classify(r.Error); isPermanentErrorCode(code) {
+				invalidTokens = append(invalidTokens, InvalidToken{Token: msg.Tokens[idx], Code: code})
+			}
 		}
 	}
 
-	return resp, failedTokens, nil
+	return resp, failedTokens, invalidTokens, nil
 }
 
 // Send sends a message to the GCM server, retrying in case of service
-// unavailability. A non-nil error is returned if a non-recoverable
+// unavailability. It is a thin wrapper around SendContext using
+// context.Background().
+//
+// Note that messages are retried using exponential backoff, and as a
+// result, this method may block for several seconds.
+func (s *Sender) Send(msg *messaging.MulticastMessage, retries int) (*messaging.BatchResponse, []string, []InvalidToken, error) {
+	return s.SendContext(context.Background(), msg, retries)
+}
+
+// SendContext sends a message to the GCM server, retrying in case of
+// service unavailability. A non-nil error is returned if a non-recoverable
 // error occurs (i.e. if the response status is not "200 OK").
 //
 // Note that messages are retried using exponential backoff, and as a
+// result, this method may block for several seconds. Canceling ctx aborts
+// both the in-flight HTTP call and any pending backoff wait, returning the
+// partial results collected so far.
+func (s *Sender) SendContext(ctx context.Context, msg *messaging.MulticastMessage, retries int) (*messaging.BatchResponse, []string, []InvalidToken, error) {
+	return s.sendWithRetry(ctx, msg, retries, s.SendNoRetryContext)
+}
+
+// SendEachNoRetry sends a message to the FCM server, issuing one HTTP
+// request per token concurrently (bounded by maxConcurrentSendEach)
+// instead of a single batch request. A non-nil error is only returned if
+// msg or the sender itself is malformed; a network or auth failure on an
+// individual token is instead recorded on that token's SendResponse, so
+// the rest of the tokens are unaffected and the caller can retry just the
+// failed ones.
+// If msg is a valid MulticastMessage, then the failed tokens and any
+// permanently invalid tokens found among them will also be returned.
+func (s *Sender) SendEachNoRetry(msg *messaging.MulticastMessage) (*messaging.BatchResponse, []string, []InvalidToken, error) {
+	// Note that failed tokens returns as nil, since we cannot guarantee that msg.Tokens exists
+	if err := checkMessage(msg); err != nil {
+		return nil, nil, nil, err
+	} else if err = checkSender(s); err != nil {
+		return nil, msg.Tokens, nil, err
+	}
+
+	responses := make([]*messaging.SendResponse, len(msg.Tokens))
+	sem := make(chan struct{}, maxConcurrentSendEach)
+	var wg sync.WaitGroup
+	for i, token := range msg.Tokens {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, token string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			name, err := s.sendSingle(context.Background(), singleMessageFromMulticast(msg, token))
+			if err != nil {
+				err = wrapClassified(Classify(err), err)
+			}
+			responses[i] = &messaging.SendResponse{Success: err == nil, MessageID: name, Error: err}
+		}(i, token)
+	}
+	wg.Wait()
+
+	var successCount int
+	var failedTokens []string
+	var invalidTokens []InvalidToken
+	for i, r := range responses {
+		if r.Success {
+			successCount++
+		} else {
+			failedTokens = append(failedTokens, msg.Tokens[i])
+			if code := Classify(r.Error); isPermanentErrorCode(code) {
+				invalidTokens = append(invalidTokens, InvalidToken{Token: msg.Tokens[i], Code: code})
+			}
+		}
+	}
+
+	resp := &messaging.BatchResponse{
+		SuccessCount: successCount,
+		FailureCount: len(responses) - successCount,
+		Responses:    responses,
+	}
+
+	return resp, failedTokens, invalidTokens, nil
+}
+
+// SendEach sends a message to the GCM server the same way SendEachNoRetry
+// does, retrying recoverable per-token failures in case of service
+// unavailability. As with SendEachNoRetry, a failure on an individual
+// token is recorded on that token's SendResponse; a non-nil error is only
+// returned if msg or the sender itself is malformed, or retries is
+// negative.
+//
+// Note that messages are retried using exponential backoff, and as a
 // result, this method may block for several seconds.
-func (s *Sender) Send(msg *messaging.MulticastMessage, retries int) (*messaging.BatchResponse, []string, error) {
+func (s *Sender) SendEach(msg *messaging.MulticastMessage, retries int) (*messaging.BatchResponse, []string, []InvalidToken, error) {
+	return s.sendWithRetry(context.Background(), msg, retries, func(_ context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, []string, []InvalidToken, error) {
+		return s.SendEachNoRetry(msg)
+	})
+}
+
+// SendMessageNoRetry sends a single Message — addressed to a topic, a
+// condition, or an individual token — to the FCM server without retrying
+// in case of service unavailability. It is a thin wrapper around
+// SendMessageNoRetryContext using context.Background().
+func (s *Sender) SendMessageNoRetry(msg *messaging.Message) (string, error) {
+	return s.SendMessageNoRetryContext(context.Background(), msg)
+}
+
+// SendMessageNoRetryContext sends a single Message — addressed to a
+// topic, a condition, or an individual token — to the FCM server without
+// retrying in case of service unavailability. It returns the
+// FCM-assigned message name on success. Unlike SendNoRetryContext and
+// SendEachNoRetry, this is the entry point for the addressing modes a
+// MulticastMessage cannot express. Canceling ctx aborts the underlying
+// HTTP call.
+func (s *Sender) SendMessageNoRetryContext(ctx context.Context, msg *messaging.Message) (string, error) {
+	if msg == nil {
+		return "", errors.New("the message must not be nil")
+	} else if err := checkSender(s); err != nil {
+		return "", err
+	}
+	name, err := s.sendSingle(ctx, msg)
+	if err != nil {
+		return "", wrapClassified(Classify(err), err)
+	}
+	return name, nil
+}
+
+// sendMulticast sends msg via the normal multicast endpoint, or its
+// validate-only counterpart when s.DryRun is set.
+func (s *Sender) sendMulticast(ctx context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	if s.DryRun {
+		return s.Client.SendMulticastDryRun(ctx, msg)
+	}
+	return s.Client.SendMulticast(ctx, msg)
+}
+
+// sendSingle sends msg via the normal single-message endpoint, or its
+// validate-only counterpart when s.DryRun is set, and returns the
+// FCM-assigned message name on success. Client.Send and Client.SendDryRun
+// return a BatchResponse for the single message passed in, so a non-nil
+// error here only indicates the whole call failed (e.g. a transport or
+// auth error); msg's own delivery outcome lives in Responses[0] and is
+// surfaced as this method's error instead.
+func (s *Sender) sendSingle(ctx context.Context, msg *messaging.Message) (string, error) {
+	var resp *messaging.BatchResponse
+	var err error
+	if s.DryRun {
+		resp, err = s.Client.SendDryRun(ctx, msg)
+	} else {
+		resp, err = s.Client.Send(ctx, msg)
+	}
+	if err != nil {
+		return "", err
+	}
+	result := resp.Responses[0]
+	if !result.Success {
+		return "", result.Error
+	}
+	return result.MessageID, nil
+}
+
+// SendMessage sends a single Message the same way SendMessageNoRetry does,
+// retrying in case of a recoverable error. It is a thin wrapper around
+// SendMessageContext using context.Background().
+//
+// Note that messages are retried using exponential backoff — except that
+// a QUOTA_EXCEEDED error honors any Retry-After delay FCM included on the
+// response instead — and as a result, this method may block for several
+// seconds.
+func (s *Sender) SendMessage(msg *messaging.Message, retries int) (string, error) {
+	return s.SendMessageContext(context.Background(), msg, retries)
+}
+
+// SendMessageContext sends a single Message the same way
+// SendMessageNoRetryContext does, retrying in case of a recoverable
+// error. A non-nil error is returned if a non-recoverable error occurs.
+// It shares its backoff policy with sendWithRetry via waitForRetry, so
+// Send, SendEach, and SendMessage all retry the same way.
+//
+// Note that messages are retried using exponential backoff — except that
+// a QUOTA_EXCEEDED error honors any Retry-After delay FCM included on the
+// response instead — and as a result, this method may block for several
+// seconds. Canceling ctx aborts both an in-flight send and the wait
+// before the next retry, and returns the last outcome observed.
+func (s *Sender) SendMessageContext(ctx context.Context, msg *messaging.Message, retries int) (string, error) {
+	if msg == nil {
+		return "", errors.New("the message must not be nil")
+	} else if err := checkSender(s); err != nil {
+		return "", err
+	} else if retries < 0 {
+		return "", errors.New("retries must not be negative")
+	}
+
+	name, err := s.SendMessageNoRetryContext(ctx, msg)
+	backoff := backoffInitialDelay
+	for i := 0; i < retries && err != nil && isRecoverableError(err); i++ {
+		var retryAfter time.Duration
+		if Classify(err) == ErrorCodeQuotaExceeded {
+			if d, ok := retryAfterDelay(err); ok {
+				retryAfter = d
+			}
+		}
+		if waitErr := waitForRetry(ctx, &backoff, retryAfter); waitErr != nil {
+			return name, err
+		}
+		name, err = s.SendMessageNoRetryContext(ctx, msg)
+	}
+
+	return name, err
+}
+
+// sendWithRetry runs sendOnce once and, if one or more tokens failed with a
+// recoverable error, retries just those tokens until they succeed or
+// retries is exhausted. It backs both Send and SendEach so the two sending
+// strategies share one retry policy. Retries normally use exponential
+// backoff, except that a QUOTA_EXCEEDED response honors any Retry-After
+// delay FCM included on the HTTP response instead. Canceling ctx aborts
+// the wait before the next retry and returns the partial results
+// collected so far. An in-flight sendOnce call is given ctx too, and is
+// interrupted only if sendOnce honors it (SendEach's does not).
+func (s *Sender) sendWithRetry(ctx context.Context, msg *messaging.MulticastMessage, retries int, sendOnce func(ctx context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, []string, []InvalidToken, error)) (*messaging.BatchResponse, []string, []InvalidToken, error) {
 	// Note that failed tokens returns as nil, since we cannot guarantee that msg.Tokens exists
 	if err := checkMessage(msg); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	} else if err = checkSender(s); err != nil {
-		return nil, msg.Tokens, err
+		return nil, msg.Tokens, nil, err
 	} else if retries < 0 {
-		return nil, msg.Tokens, errors.New("retries must not be negative")
+		return nil, msg.Tokens, nil, errors.New("retries must not be negative")
 	}
 
 	// Send the message for the first time.
-	resp, failedTokens, err := s.SendNoRetry(msg)
+	resp, failedTokens, invalidTokens, err := sendOnce(ctx, msg)
 	if err != nil {
-		return nil, failedTokens, err
+		return nil, failedTokens, invalidTokens, err
 	} else if resp.FailureCount == 0 || retries == 0 {
-		return resp, failedTokens, nil
+		return resp, failedTokens, invalidTokens, nil
 	}
 
 	// One or more messages failed to send.
 	regIDs := msg.Tokens
 	allResults := make(map[string]*messaging.SendResponse, len(regIDs))
-	backoff := backoffInitialDelay
-	for i := 0; updateStatus(msg, resp, allResults) > 0 && i < retries; i++ {
-		sleepTime := backoff/2 + rand.Intn(backoff)
-		time.Sleep(time.Duration(sleepTime) * time.Millisecond)
-		backoff = min(2*backoff, maxBackoffDelay)
-		if resp, failedTokens, err = s.SendNoRetry(msg); err != nil {
-			msg.Tokens = regIDs
-			return nil, failedTokens, err
-		}
-	}
 
-	// Restore the original list of registration tokens.
-	msg.Tokens = regIDs
+	// finalize builds the final BatchResponse, failed token list, and
+	// invalid token list spanning every attempt so far, and restores the
+	// original list of registration tokens on msg.
+	finalize := func() (*messaging.BatchResponse, []string, []InvalidToken, error) {
+		msg.Tokens = regIDs
 
-	// Create a final BatchResponse and list of failed tokens.
-	finalResponses := make([]*messaging.SendResponse, len(regIDs))
-	for i, token := range regIDs {
-		if result, ok := allResults[token]; ok {
+		finalResponses := make([]*messaging.SendResponse, len(regIDs))
+		var finalFailedTokens []string
+		var finalInvalidTokens []InvalidToken
+		var successCount int
+		for i, token := range regIDs {
+			result, ok := allResults[token]
+			if !ok {
+				result = &messaging.SendResponse{
+					Success: false,
+					Error:   errors.New("unknown error"),
+				}
+			}
 			finalResponses[i] = result
-		} else {
-			finalResponses[i] = &messaging.SendResponse{
-				Success: false,
-				Error:   errors.New("unknown error"),
+			if result.Success {
+				successCount++
+			} else {
+				finalFailedTokens = append(finalFailedTokens, token)
+				if code := Classify(result.Error); isPermanentErrorCode(code) {
+					finalInvalidTokens = append(finalInvalidTokens, InvalidToken{Token: token, Code: code})
+				}
 			}
 		}
+
+		finalBatchResponse := &messaging.BatchResponse{
+			SuccessCount: successCount,
+			FailureCount: len(regIDs) - successCount,
+			Responses:    finalResponses,
+		}
+
+		return finalBatchResponse, finalFailedTokens, finalInvalidTokens, nil
 	}
 
-	finalBatchResponse := &messaging.BatchResponse{
-		SuccessCount: resp.SuccessCount,
-		FailureCount: resp.FailureCount,
-		Responses:    finalResponses,
+	backoff := backoffInitialDelay
+	for i := 0; ; i++ {
+		remaining, retryAfter := updateStatus(msg, resp, allResults)
+		if remaining == 0 || i == retries {
+			break
+		}
+
+		if err := waitForRetry(ctx, &backoff, retryAfter); err != nil {
+			return finalize()
+		}
+
+		if resp, failedTokens, invalidTokens, err = sendOnce(ctx, msg); err != nil {
+			msg.Tokens = regIDs
+			return nil, failedTokens, invalidTokens, err
+		}
 	}
 
-	return finalBatchResponse, failedTokens, nil
+	return finalize()
 }
 
-// updateStatus updates the status of the messages sent to devices and
-// returns the number of recoverable errors that could be retried.
-func updateStatus(msg *messaging.MulticastMessage, resp *messaging.BatchResponse, allResults map[string]*messaging.SendResponse) int {
+// waitForRetry sleeps for the delay a retry should wait before the next
+// attempt: retryAfter, if positive (a QUOTA_EXCEEDED response's
+// Retry-After), or otherwise the next exponential-backoff delay, which it
+// advances in place. It backs both sendWithRetry and SendMessageContext
+// so every retrying entry point in this package shares one backoff
+// policy. Canceling ctx aborts the wait early and returns ctx.Err().
+func waitForRetry(ctx context.Context, backoff *int, retryAfter time.Duration) error {
+	var sleepDuration time.Duration
+	if retryAfter > 0 {
+		sleepDuration = retryAfter
+	} else {
+		sleepDuration = time.Duration(*backoff/2+rand.Intn(*backoff)) * time.Millisecond
+		*backoff = min(2*(*backoff), maxBackoffDelay)
+	}
+
+	timer := time.NewTimer(sleepDuration)
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	}
+}
+
+// updateStatus updates the status of the messages sent to devices, returns
+// the number of recoverable errors that could be retried, and, if any of
+// them is a QUOTA_EXCEEDED response carrying a Retry-After header, the
+// longest such delay.
+func updateStatus(msg *messaging.MulticastMessage, resp *messaging.BatchResponse, allResults map[string]*messaging.SendResponse) (int, time.Duration) {
 	unsentRegIDs := make([]string, 0, resp.FailureCount)
+	var retryAfter time.Duration
 	for i := 0; i < len(resp.Responses); i++ {
 		regID := msg.Tokens[i]
 		allResults[regID] = resp.Responses[i]
-		if resp.Responses[i].Error != nil && isRecoverableError(resp.Responses[i].Error) {
+		respErr := resp.Responses[i].Error
+		if respErr != nil && isRecoverableError(respErr) {
 			unsentRegIDs = append(unsentRegIDs, regID)
+			if Classify(respErr) == ErrorCodeQuotaExceeded {
+				if d, ok := retryAfterDelay(respErr); ok && d > retryAfter {
+					retryAfter = d
+				}
+			}
 		}
 	}
 	msg.Tokens = unsentRegIDs
-	return len(unsentRegIDs)
-}
-
-// isRecoverableError checks if the error is a recoverable error.
-// This is under the assumption that Legacy and HTTP V1 + SDK return
-// the same errors.
-// For more info, check out:
-// https://firebase.google.com/docs/cloud-messaging/send-message#rest
-func isRecoverableError(err error) bool {
-	return err.Error() == "Unavailable"
+	return len(unsentRegIDs), retryAfter
 }
 
 // checkSender returns an error if the sender is not well-formed and
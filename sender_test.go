@@ -8,9 +8,13 @@ import (
 	"fmt"
 	"github.com/appleboy/go-fcm"
 	"golang.org/x/oauth2"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testResponse struct {
@@ -59,11 +63,140 @@ func startTestServer(t *testing.T, responses ...*testResponse) *httptest.Server
 	return server
 }
 
+// startRecordingTestServer behaves like startTestServer, but also records
+// the raw body of every request it receives, so tests can assert on the
+// payload FCM would have seen (e.g. the validate_only flag for dry runs).
+func startRecordingTestServer(t *testing.T, responses ...*testResponse) (*httptest.Server, *[]string) {
+	var bodies []string
+	i := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if i >= len(responses) {
+			t.Fatalf("server received %d requests, expected %d", i+1, len(responses))
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		resp := responses[i]
+		status := resp.StatusCode
+		if status == 0 || status == http.StatusOK {
+			w.Header().Set("Content-Type", "application/json")
+			respBytes, _ := json.Marshal(resp.Response)
+			fmt.Fprint(w, string(respBytes))
+		} else {
+			w.WriteHeader(status)
+		}
+		i++
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	return server, &bodies
+}
+
+// fcmErrorResponse synthesizes the response body FCM v1's messages:send
+// endpoint returns for a classified failure, per
+// https://firebase.google.com/docs/reference/fcm/rest/v1/ErrorCode
+type fcmErrorResponse struct {
+	Code    ErrorCode
+	Message string
+}
+
+// fcmErrorHTTPStatus maps each classified error to the HTTP status FCM
+// v1 documents for it.
+var fcmErrorHTTPStatus = map[ErrorCode]int{
+	ErrorCodeUnregistered:     http.StatusNotFound,
+	ErrorCodeInvalidArgument:  http.StatusBadRequest,
+	ErrorCodeSenderIDMismatch: http.StatusForbidden,
+	ErrorCodeQuotaExceeded:    http.StatusTooManyRequests,
+	ErrorCodeUnavailable:      http.StatusServiceUnavailable,
+	ErrorCodeInternal:         http.StatusInternalServerError,
+	ErrorCodeThirdPartyAuth:   http.StatusUnauthorized,
+}
+
+func (e *fcmErrorResponse) write(w http.ResponseWriter) {
+	status := fcmErrorHTTPStatus[e.Code]
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	msg := e.Message
+	if msg == "" {
+		msg = string(e.Code)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q,"status":%q,"details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":%q}]}}`, status, msg, e.Code, e.Code)
+}
+
+// messageResponse is one canned reply for a single POST to FCM v1's
+// messages:send endpoint — the endpoint every outbound call in this
+// package ends up hitting once per message, whether directly through
+// Client.Send/SendDryRun or via Client.SendMulticast/SendMulticastDryRun's
+// internal per-message fanout.
+type messageResponse struct {
+	// MessageID is returned as {"name": MessageID} with a 200 OK when Err
+	// is nil.
+	MessageID string
+	// Err, when set, is returned instead as the non-2xx status and body
+	// FCM reports for that error class.
+	Err *fcmErrorResponse
+}
+
+func (r *messageResponse) write(w http.ResponseWriter) {
+	if r.Err != nil {
+		r.Err.write(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"name":%q}`, r.MessageID)
+}
+
+// startMessageTestServer serves responses in order, one per request
+// reaching FCM's messages:send endpoint.
+func startMessageTestServer(t *testing.T, responses ...*messageResponse) *httptest.Server {
+	var mu sync.Mutex
+	i := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if i >= len(responses) {
+			t.Fatalf("server received %d requests, expected %d", i+1, len(responses))
+			return
+		}
+		resp := responses[i]
+		i++
+		resp.write(w)
+	}
+	return httptest.NewServer(http.HandlerFunc(handler))
+}
+
+// startRecordingMessageTestServer behaves like startMessageTestServer, but
+// also records the raw body of every request it receives, so tests can
+// assert on the payload FCM would have seen (e.g. the validate_only flag
+// for dry runs).
+func startRecordingMessageTestServer(t *testing.T, responses ...*messageResponse) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var bodies []string
+	i := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(body))
+		if i >= len(responses) {
+			t.Fatalf("server received %d requests, expected %d", i+1, len(responses))
+			return
+		}
+		resp := responses[i]
+		i++
+		resp.write(w)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	return server, &bodies
+}
+
 func TestSendNoRetryInvalidApiKey(t *testing.T) {
 	server := startTestServer(t)
 	defer server.Close()
 	sender := &Sender{CredentialsJson: ""}
-	if _, _, err := sender.SendNoRetry(&messaging.MulticastMessage{Tokens: []string{"1"}}); err == nil {
+	if _, _, _, err := sender.SendNoRetry(&messaging.MulticastMessage{Tokens: []string{"1"}}); err == nil {
 		t.Fatal("test should fail when sender's CredentialsJson is \"\"")
 	}
 }
@@ -72,7 +205,7 @@ func TestSendInvalidApiKey(t *testing.T) {
 	server := startTestServer(t)
 	defer server.Close()
 	sender := &Sender{CredentialsJson: ""}
-	if _, _, err := sender.Send(&messaging.MulticastMessage{Tokens: []string{"1"}}, 0); err == nil {
+	if _, _, _, err := sender.Send(&messaging.MulticastMessage{Tokens: []string{"1"}}, 0); err == nil {
 		t.Fatal("test should fail when sender's CredentialsJson is \"\"")
 	}
 }
@@ -81,16 +214,16 @@ func TestSendNoRetryInvalidMessage(t *testing.T) {
 	server := startTestServer(t)
 	defer server.Close()
 	sender := &Sender{CredentialsJson: "test"}
-	if _, _, err := sender.SendNoRetry(nil); err == nil {
+	if _, _, _, err := sender.SendNoRetry(nil); err == nil {
 		t.Fatal("test should fail when message is nil")
 	}
-	if _, _, err := sender.SendNoRetry(&messaging.MulticastMessage{}); err == nil {
+	if _, _, _, err := sender.SendNoRetry(&messaging.MulticastMessage{}); err == nil {
 		t.Fatal("test should fail when message Tokens field is nil")
 	}
-	if _, _, err := sender.SendNoRetry(&messaging.MulticastMessage{Tokens: []string{}}); err == nil {
+	if _, _, _, err := sender.SendNoRetry(&messaging.MulticastMessage{Tokens: []string{}}); err == nil {
 		t.Fatal("test should fail when message Tokens field is an empty slice")
 	}
-	if _, _, err := sender.SendNoRetry(&messaging.MulticastMessage{Tokens: make([]string, 501)}); err == nil {
+	if _, _, _, err := sender.SendNoRetry(&messaging.MulticastMessage{Tokens: make([]string, 501)}); err == nil {
 		t.Fatal("test should fail when more than 500 Tokens are specified")
 	}
 }
@@ -99,66 +232,340 @@ func TestSendInvalidMessage(t *testing.T) {
 	server := startTestServer(t)
 	defer server.Close()
 	sender := &Sender{CredentialsJson: "test"}
-	if _, _, err := sender.Send(nil, 0); err == nil {
+	if _, _, _, err := sender.Send(nil, 0); err == nil {
 		t.Fatal("test should fail when message is nil")
 	}
-	if _, _, err := sender.Send(&messaging.MulticastMessage{}, 0); err == nil {
+	if _, _, _, err := sender.Send(&messaging.MulticastMessage{}, 0); err == nil {
 		t.Fatal("test should fail when message Tokens field is nil")
 	}
-	if _, _, err := sender.Send(&messaging.MulticastMessage{Tokens: []string{}}, 0); err == nil {
+	if _, _, _, err := sender.Send(&messaging.MulticastMessage{Tokens: []string{}}, 0); err == nil {
 		t.Fatal("test should fail when message Tokens field is an empty slice")
 	}
-	if _, _, err := sender.Send(&messaging.MulticastMessage{Tokens: make([]string, 1001)}, 0); err == nil {
+	if _, _, _, err := sender.Send(&messaging.MulticastMessage{Tokens: make([]string, 1001)}, 0); err == nil {
 		t.Fatal("test should fail when more than 1000 Tokens are specified")
 	}
 
 }
 
 func TestSendNoRetrySuccess(t *testing.T) {
-	server := startTestServer(t, &testResponse{Response: &messaging.BatchResponse{}})
+	server := startMessageTestServer(t, &messageResponse{MessageID: "projects/test/messages/1"})
 	defer server.Close()
 	client, _ := getMockClient(server)
 	sender := &Sender{CredentialsJson: "test", Client: client}
-	msg := NewMessage(map[string]string{"key": "value"}, "1")
-	if _, _, err := sender.SendNoRetry(msg); err != nil {
+	msg := NewMessage(map[string]string{"key": "value"}, nil, "1")
+	if _, _, _, err := sender.SendNoRetry(msg); err != nil {
 		t.Fatalf("test failed with error: %s", err)
 	}
 }
 
+func TestSendNoRetryDryRun(t *testing.T) {
+	server, bodies := startRecordingMessageTestServer(t, &messageResponse{MessageID: "projects/test/messages/1"})
+	defer server.Close()
+	client, _ := getMockClient(server)
+	sender := &Sender{CredentialsJson: "test", Client: client, DryRun: true}
+	msg := NewMessage(map[string]string{"key": "value"}, nil, "1")
+	if _, _, _, err := sender.SendNoRetry(msg); err != nil {
+		t.Fatalf("test failed with error: %s", err)
+	}
+	if len(*bodies) != 1 || !strings.Contains((*bodies)[0], `"validate_only":true`) {
+		t.Fatalf("expected dry run request to set validate_only, got %q", *bodies)
+	}
+}
+
 func TestSendNoRetryNonrecoverableFailure(t *testing.T) {
-	server := startTestServer(t, &testResponse{StatusCode: http.StatusBadRequest})
+	// A non-recoverable failure is per-token, not a failure of the whole
+	// call: SendNoRetry's own error stays nil, and the token instead shows
+	// up as invalid.
+	server := startMessageTestServer(t, &messageResponse{Err: &fcmErrorResponse{Code: ErrorCodeInvalidArgument}})
 	defer server.Close()
-	sender := &Sender{CredentialsJson: "test"}
-	msg := NewMessage(map[string]string{"key": "value"}, "1")
-	if _, _, err := sender.SendNoRetry(msg); err == nil {
-		t.Fatal("test expected non-recoverable error")
+	client, _ := getMockClient(server)
+	sender := &Sender{CredentialsJson: "test", Client: client}
+	msg := NewMessage(map[string]string{"key": "value"}, nil, "1")
+	_, failedTokens, invalidTokens, err := sender.SendNoRetry(msg)
+	if err != nil {
+		t.Fatalf("test failed with error: %s", err)
+	}
+	if len(failedTokens) != 1 || len(invalidTokens) != 1 {
+		t.Fatal("expected the non-recoverable failure to be reported as an invalid token")
 	}
 }
 
 func TestSendSuccess(t *testing.T) {
-	server := startTestServer(t,
-		&testResponse{Response: &messaging.BatchResponse{FailureCount: 1, Responses: []*messaging.SendResponse{{Error: errors.New("Unavailable")}}}},
-		&testResponse{Response: &messaging.BatchResponse{FailureCount: 1, Responses: []*messaging.SendResponse{{Error: errors.New("Unavailable")}}}},
+	server := startMessageTestServer(t,
+		&messageResponse{Err: &fcmErrorResponse{Code: ErrorCodeUnavailable}},
+		&messageResponse{MessageID: "projects/test/messages/1"},
 	)
 	defer server.Close()
 	client, _ := getMockClient(server)
 	sender := &Sender{CredentialsJson: "test", Client: client}
-	msg := NewMessage(map[string]string{"key": "value"}, "1")
-	resp, _, err := sender.Send(msg, 1)
+	msg := NewMessage(map[string]string{"key": "value"}, nil, "1")
+	resp, _, _, err := sender.Send(msg, 1)
 	if err != nil || resp.SuccessCount != 1 {
 		t.Fatal("send should return response with one success")
 	}
 }
 
+func TestSendEachNoRetryInvalidApiKey(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	sender := &Sender{CredentialsJson: ""}
+	if _, _, _, err := sender.SendEachNoRetry(&messaging.MulticastMessage{Tokens: []string{"1"}}); err == nil {
+		t.Fatal("test should fail when sender's CredentialsJson is \"\"")
+	}
+}
+
+func TestSendEachInvalidApiKey(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	sender := &Sender{CredentialsJson: ""}
+	if _, _, _, err := sender.SendEach(&messaging.MulticastMessage{Tokens: []string{"1"}}, 0); err == nil {
+		t.Fatal("test should fail when sender's CredentialsJson is \"\"")
+	}
+}
+
+func TestSendEachNoRetryInvalidMessage(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	sender := &Sender{CredentialsJson: "test"}
+	if _, _, _, err := sender.SendEachNoRetry(nil); err == nil {
+		t.Fatal("test should fail when message is nil")
+	}
+	if _, _, _, err := sender.SendEachNoRetry(&messaging.MulticastMessage{}); err == nil {
+		t.Fatal("test should fail when message Tokens field is nil")
+	}
+	if _, _, _, err := sender.SendEachNoRetry(&messaging.MulticastMessage{Tokens: []string{}}); err == nil {
+		t.Fatal("test should fail when message Tokens field is an empty slice")
+	}
+	if _, _, _, err := sender.SendEachNoRetry(&messaging.MulticastMessage{Tokens: make([]string, 501)}); err == nil {
+		t.Fatal("test should fail when more than 500 Tokens are specified")
+	}
+}
+
+func TestSendEachNoRetryPerTokenFailure(t *testing.T) {
+	// Client.Send hits FCM's single-message messages:send endpoint, which
+	// reports a failure as a non-2xx classified error body, not a
+	// BatchResponse-shaped success.
+	server := startMessageTestServer(t, &messageResponse{Err: &fcmErrorResponse{Code: ErrorCodeUnavailable}})
+	defer server.Close()
+	client, _ := getMockClient(server)
+	sender := &Sender{CredentialsJson: "test", Client: client}
+	msg := NewMessage(map[string]string{"key": "value"}, nil, "1")
+	resp, failedTokens, _, err := sender.SendEachNoRetry(msg)
+	if err != nil {
+		t.Fatalf("test failed with error: %s", err)
+	}
+	if resp.FailureCount != 1 || len(failedTokens) != 1 {
+		t.Fatal("expected the per-token failure to be recorded, not silently treated as success")
+	}
+}
+
+func TestSendMessageNoRetryInvalidApiKey(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	sender := &Sender{CredentialsJson: ""}
+	if _, err := sender.SendMessageNoRetry(NewTopicMessage("news", nil, nil)); err == nil {
+		t.Fatal("test should fail when sender's CredentialsJson is \"\"")
+	}
+}
+
+func TestSendMessageInvalidApiKey(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	sender := &Sender{CredentialsJson: ""}
+	if _, err := sender.SendMessage(NewTopicMessage("news", nil, nil), 0); err == nil {
+		t.Fatal("test should fail when sender's CredentialsJson is \"\"")
+	}
+}
+
+func TestSendMessageNoRetryInvalidMessage(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	sender := &Sender{CredentialsJson: "test"}
+	if _, err := sender.SendMessageNoRetry(nil); err == nil {
+		t.Fatal("test should fail when message is nil")
+	}
+}
+
+func TestSendMessageInvalidMessage(t *testing.T) {
+	server := startTestServer(t)
+	defer server.Close()
+	sender := &Sender{CredentialsJson: "test"}
+	if _, err := sender.SendMessage(nil, 0); err == nil {
+		t.Fatal("test should fail when message is nil")
+	}
+}
+
+func TestSendMessageNoRetryDryRun(t *testing.T) {
+	server, bodies := startRecordingMessageTestServer(t, &messageResponse{MessageID: "projects/test/messages/1"})
+	defer server.Close()
+	client, _ := getMockClient(server)
+	sender := &Sender{CredentialsJson: "test", Client: client, DryRun: true}
+	if _, err := sender.SendMessageNoRetry(NewTopicMessage("news", nil, nil)); err != nil {
+		t.Fatalf("test failed with error: %s", err)
+	}
+	if len(*bodies) != 1 || !strings.Contains((*bodies)[0], `"validate_only":true`) {
+		t.Fatalf("expected dry run request to set validate_only, got %q", *bodies)
+	}
+}
+
+func TestSendChunkedInvalidMessage(t *testing.T) {
+	sender := &Sender{CredentialsJson: "test"}
+	if _, _, _, err := sender.SendChunked(nil, 0); err == nil {
+		t.Fatal("test should fail when message is nil")
+	}
+	if _, _, _, err := sender.SendChunked(&messaging.MulticastMessage{}, 0); err == nil {
+		t.Fatal("test should fail when message Tokens field is empty")
+	}
+}
+
+func TestSendChunkedMultipleChunks(t *testing.T) {
+	// SendMulticast fans out to one HTTP request per message rather than
+	// one request per chunk, so the fake server here must tolerate that
+	// many concurrent requests and answer each independently instead of
+	// replaying a fixed, ordered list of per-chunk responses.
+	var mu sync.Mutex
+	var requestCount int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requestCount++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name":"projects/test/messages/1"}`)
+	}))
+	defer server.Close()
+	client, _ := getMockClient(server)
+	sender := &Sender{CredentialsJson: "test", Client: client}
+	tokens := make([]string, 501)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("token-%d", i)
+	}
+	msg := NewMessage(map[string]string{"key": "value"}, nil, tokens...)
+	resp, _, _, err := sender.SendChunked(msg, 0)
+	if err != nil {
+		t.Fatalf("test failed with error: %s", err)
+	}
+	if len(resp.Responses) != len(tokens) {
+		t.Fatalf("expected %d responses, got %d", len(tokens), len(resp.Responses))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requestCount != len(tokens) {
+		t.Fatalf("expected one HTTP request per token (%d), got %d", len(tokens), requestCount)
+	}
+}
+
+func TestSendChunkedPartialChunkFailure(t *testing.T) {
+	// The first (500-token) chunk's underlying connections are reset
+	// before FCM can respond, simulating a transport-level failure of
+	// that whole chunk's send, while the second (1-token) chunk succeeds
+	// normally. ChunkError should report only the failing chunk, and the
+	// successful chunk's response should still come through.
+	var mu sync.Mutex
+	var requestCount int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requestCount++
+		failing := requestCount <= maxTokensPerSend
+		mu.Unlock()
+
+		if failing {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Fatal("test server does not support hijacking")
+			}
+			conn, _, err := hj.Hijack()
+			if err != nil {
+				t.Fatalf("hijack failed: %s", err)
+			}
+			conn.Close()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name":"projects/test/messages/1"}`)
+	}))
+	defer server.Close()
+	client, _ := getMockClient(server)
+	sender := &Sender{CredentialsJson: "test", Client: client}
+	tokens := make([]string, maxTokensPerSend+1)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("token-%d", i)
+	}
+	msg := NewMessage(map[string]string{"key": "value"}, nil, tokens...)
+	resp, _, _, err := sender.SendChunked(msg, 0)
+
+	var chunkErr *ChunkError
+	if !errors.As(err, &chunkErr) {
+		t.Fatalf("expected a *ChunkError, got %v", err)
+	}
+	if chunkErr.TotalChunks != 2 || len(chunkErr.Errors) != 1 {
+		t.Fatalf("expected exactly one of two chunks to have failed, got %+v", chunkErr)
+	}
+	if _, failed := chunkErr.Errors[0]; !failed {
+		t.Fatal("expected the first (500-token) chunk to be the one reported as failed")
+	}
+	if resp == nil || len(resp.Responses) != len(tokens) {
+		t.Fatalf("expected responses for all %d tokens despite the chunk failure, got %d", len(tokens), len(resp.Responses))
+	}
+}
+
 func TestSendOneRetryNonrecoverableFailure(t *testing.T) {
-	server := startTestServer(t,
-		&testResponse{Response: &messaging.BatchResponse{FailureCount: 1, Responses: []*messaging.SendResponse{{Error: errors.New("Unavailable")}}}},
-		&testResponse{StatusCode: http.StatusBadRequest},
+	// The token fails recoverably on the first attempt and is retried,
+	// then comes back non-recoverable on the second: the retry loop must
+	// stop there even though a second retry (of 2 allowed) is still
+	// available, rather than spending it on a token already classified
+	// as permanently invalid.
+	server := startMessageTestServer(t,
+		&messageResponse{Err: &fcmErrorResponse{Code: ErrorCodeUnavailable}},
+		&messageResponse{Err: &fcmErrorResponse{Code: ErrorCodeInvalidArgument}},
 	)
 	defer server.Close()
-	sender := &Sender{CredentialsJson: "test"}
-	msg := NewMessage(map[string]string{"key": "value"}, "1")
-	if _, _, err := sender.Send(msg, 1); err == nil {
-		t.Fatal("send should fail after one retry")
+	client, _ := getMockClient(server)
+	sender := &Sender{CredentialsJson: "test", Client: client}
+	msg := NewMessage(map[string]string{"key": "value"}, nil, "1")
+	resp, failedTokens, invalidTokens, err := sender.Send(msg, 2)
+	if err != nil {
+		t.Fatalf("test failed with error: %s", err)
+	}
+	if resp.FailureCount != 1 || len(failedTokens) != 1 || len(invalidTokens) != 1 {
+		t.Fatal("expected the retry loop to stop once the token was classified as non-recoverable")
+	}
+}
+
+func TestSendContextCanceledDuringBackoff(t *testing.T) {
+	// Only one response is configured: if the canceled context failed to
+	// abort the retry loop, the second request would make the server
+	// t.Fatalf.
+	server := startMessageTestServer(t, &messageResponse{Err: &fcmErrorResponse{Code: ErrorCodeUnavailable}})
+	defer server.Close()
+	client, _ := getMockClient(server)
+	sender := &Sender{CredentialsJson: "test", Client: client}
+	msg := NewMessage(map[string]string{"key": "value"}, nil, "1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	resp, failedTokens, _, err := sender.SendContext(ctx, msg, 1)
+	if err != nil {
+		t.Fatalf("test failed with error: %s", err)
+	}
+	if resp.FailureCount != 1 || len(failedTokens) != 1 {
+		t.Fatal("expected the canceled retry to return the original failure untouched")
+	}
+}
+
+func TestSendMessageContextCanceledDuringBackoff(t *testing.T) {
+	// Only one response is configured: if the canceled context failed to
+	// abort the retry loop, the second request would make the server
+	// t.Fatalf. This proves SendMessageContext shares sendWithRetry's
+	// cancellation behavior rather than blocking for the full backoff.
+	server := startMessageTestServer(t, &messageResponse{Err: &fcmErrorResponse{Code: ErrorCodeUnavailable}})
+	defer server.Close()
+	client, _ := getMockClient(server)
+	sender := &Sender{CredentialsJson: "test", Client: client}
+	msg := NewTopicMessage("news", nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := sender.SendMessageContext(ctx, msg, 1); err == nil {
+		t.Fatal("expected the canceled retry to return the original failure")
 	}
 }